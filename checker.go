@@ -0,0 +1,324 @@
+// Copyright 2016 Gravitational Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rigging
+
+import (
+	"context"
+	"time"
+
+	"github.com/gravitational/trace"
+	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	apiextensionsclientset "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+	appsv1beta1 "k8s.io/client-go/pkg/apis/apps/v1beta1"
+	batchv1 "k8s.io/client-go/pkg/apis/batch/v1"
+	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+)
+
+const (
+	// KindReplicaSet is the Kind of a ReplicaSet resource
+	KindReplicaSet = "ReplicaSet"
+	// KindStatefulSet is the Kind of a StatefulSet resource
+	KindStatefulSet = "StatefulSet"
+	// KindPod is the Kind of a Pod resource
+	KindPod = "Pod"
+	// KindPersistentVolumeClaim is the Kind of a PersistentVolumeClaim resource
+	KindPersistentVolumeClaim = "PersistentVolumeClaim"
+	// KindCustomResourceDefinition is the Kind of a CustomResourceDefinition resource
+	KindCustomResourceDefinition = "CustomResourceDefinition"
+	// KindNamespace is the Kind of a Namespace resource
+	KindNamespace = "Namespace"
+)
+
+// Checker is a resource-agnostic readiness check: it knows how to
+// re-fetch the latest state of a single resource and decide whether it
+// is ready, without the caller having to know the resource's kind.
+type Checker interface {
+	// Ready fetches the latest state of the resource and reports
+	// whether it is ready.
+	Ready(ctx context.Context) (bool, error)
+}
+
+// NewCheckerFor returns a Checker for obj, dispatched on its concrete
+// type. apiExtClient is only consulted when obj is a
+// CustomResourceDefinition and may be nil otherwise.
+func NewCheckerFor(obj runtime.Object, client *kubernetes.Clientset, apiExtClient apiextensionsclientset.Interface) (Checker, error) {
+	switch o := obj.(type) {
+	case *v1beta1.Deployment:
+		return &deploymentChecker{deployment: o, client: client}, nil
+	case *v1beta1.DaemonSet:
+		return &daemonSetChecker{daemonSet: o, client: client}, nil
+	case *v1beta1.ReplicaSet:
+		return &replicaSetChecker{replicaSet: o, client: client}, nil
+	case *appsv1beta1.StatefulSet:
+		return &statefulSetChecker{statefulSet: o, client: client}, nil
+	case *v1.Pod:
+		return &podChecker{pod: o, client: client}, nil
+	case *batchv1.Job:
+		return &jobChecker{job: o, client: client}, nil
+	case *v1.Service:
+		return &serviceChecker{service: o, client: client}, nil
+	case *v1.PersistentVolumeClaim:
+		return &pvcChecker{pvc: o, client: client}, nil
+	case *v1.Namespace:
+		return &namespaceChecker{namespace: o, client: client}, nil
+	case *apiextensionsv1beta1.CustomResourceDefinition:
+		if apiExtClient == nil {
+			return nil, trace.BadParameter("apiextensions client is required to check readiness of %v", o.Name)
+		}
+		return &crdChecker{crd: o, client: apiExtClient}, nil
+	default:
+		return nil, trace.BadParameter("no readiness checker is registered for %T", obj)
+	}
+}
+
+// WaitAll walks objs and blocks until every one of them reports ready,
+// timeout elapses or ctx is cancelled, letting callers submit a whole
+// manifest and wait for the release as a unit.
+func WaitAll(ctx context.Context, objs []runtime.Object, client *kubernetes.Clientset, apiExtClient apiextensionsclientset.Interface, timeout time.Duration) error {
+	checkers := make([]Checker, 0, len(objs))
+	for _, obj := range objs {
+		checker, err := NewCheckerFor(obj, client, apiExtClient)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		checkers = append(checkers, checker)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(DefaultRetryPeriod)
+	defer ticker.Stop()
+	for {
+		allReady := true
+		for _, checker := range checkers {
+			ready, err := checker.Ready(ctx)
+			if err != nil {
+				return trace.Wrap(err)
+			}
+			if !ready {
+				allReady = false
+			}
+		}
+		if allReady {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return trace.Wrap(ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+type deploymentChecker struct {
+	deployment *v1beta1.Deployment
+	client     *kubernetes.Clientset
+}
+
+func (c *deploymentChecker) Ready(ctx context.Context) (bool, error) {
+	deployment, err := c.client.Extensions().Deployments(c.deployment.Namespace).Get(c.deployment.Name)
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	status, err := deploymentRolloutStatus(deployment)
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	if status == RolloutStatusFailed {
+		return false, trace.BadParameter("deployment %v has failed to roll out", deployment.Name)
+	}
+	return status == RolloutStatusComplete, nil
+}
+
+// daemonSetChecker applies the same generation/condition rollout pattern
+// as deploymentRolloutStatus (deployment.go), since this codebase has no
+// dedicated DaemonSetControl to host it on instead.
+type daemonSetChecker struct {
+	daemonSet *v1beta1.DaemonSet
+	client    *kubernetes.Clientset
+}
+
+func (c *daemonSetChecker) Ready(ctx context.Context) (bool, error) {
+	daemonSet, err := c.client.Extensions().DaemonSets(c.daemonSet.Namespace).Get(c.daemonSet.Name)
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	if daemonSet.Status.ObservedGeneration < daemonSet.Generation {
+		return false, nil
+	}
+	if daemonSet.Status.UpdatedNumberScheduled != daemonSet.Status.DesiredNumberScheduled {
+		return false, nil
+	}
+	return daemonSet.Status.NumberAvailable >= daemonSet.Status.DesiredNumberScheduled, nil
+}
+
+// statefulSetChecker applies the same generation/condition rollout
+// pattern as deploymentRolloutStatus (deployment.go), since this
+// codebase has no dedicated StatefulSetControl to host it on instead.
+type statefulSetChecker struct {
+	statefulSet *appsv1beta1.StatefulSet
+	client      *kubernetes.Clientset
+}
+
+func (c *statefulSetChecker) Ready(ctx context.Context) (bool, error) {
+	statefulSet, err := c.client.Apps().StatefulSets(c.statefulSet.Namespace).Get(c.statefulSet.Name)
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	if statefulSet.Status.ObservedGeneration == nil || *statefulSet.Status.ObservedGeneration < statefulSet.Generation {
+		return false, nil
+	}
+	return statefulSet.Status.CurrentRevision == statefulSet.Status.UpdateRevision, nil
+}
+
+type replicaSetChecker struct {
+	replicaSet *v1beta1.ReplicaSet
+	client     *kubernetes.Clientset
+}
+
+func (c *replicaSetChecker) Ready(ctx context.Context) (bool, error) {
+	replicaSet, err := c.client.Extensions().ReplicaSets(c.replicaSet.Namespace).Get(c.replicaSet.Name)
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	var replicas int32 = 1
+	if replicaSet.Spec.Replicas != nil {
+		replicas = *replicaSet.Spec.Replicas
+	}
+	return replicaSet.Status.ReadyReplicas >= replicas, nil
+}
+
+type podChecker struct {
+	pod    *v1.Pod
+	client *kubernetes.Clientset
+}
+
+func (c *podChecker) Ready(ctx context.Context) (bool, error) {
+	pod, err := c.client.Core().Pods(c.pod.Namespace).Get(c.pod.Name)
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == v1.PodReady {
+			return condition.Status == v1.ConditionTrue, nil
+		}
+	}
+	return false, nil
+}
+
+type jobChecker struct {
+	job    *batchv1.Job
+	client *kubernetes.Clientset
+}
+
+func (c *jobChecker) Ready(ctx context.Context) (bool, error) {
+	job, err := c.client.Batch().Jobs(c.job.Namespace).Get(c.job.Name)
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	for _, condition := range job.Status.Conditions {
+		if condition.Status != v1.ConditionTrue {
+			continue
+		}
+		switch condition.Type {
+		case batchv1.JobFailed:
+			return false, trace.BadParameter("job %v has failed: %v", job.Name, condition.Reason)
+		case batchv1.JobComplete:
+			return true, nil
+		}
+	}
+	if job.Spec.Completions == nil {
+		return job.Status.Succeeded > 0, nil
+	}
+	return job.Status.Succeeded >= *job.Spec.Completions, nil
+}
+
+type serviceChecker struct {
+	service *v1.Service
+	client  *kubernetes.Clientset
+}
+
+func (c *serviceChecker) Ready(ctx context.Context) (bool, error) {
+	service, err := c.client.Core().Services(c.service.Namespace).Get(c.service.Name)
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	switch service.Spec.Type {
+	case v1.ServiceTypeLoadBalancer:
+		for _, ingress := range service.Status.LoadBalancer.Ingress {
+			if ingress.IP != "" || ingress.Hostname != "" {
+				return true, nil
+			}
+		}
+		return false, nil
+	default:
+		// ClusterIP, NodePort and ExternalName services have no
+		// rollout of their own, so they're ready as soon as they exist.
+		return true, nil
+	}
+}
+
+type pvcChecker struct {
+	pvc    *v1.PersistentVolumeClaim
+	client *kubernetes.Clientset
+}
+
+func (c *pvcChecker) Ready(ctx context.Context) (bool, error) {
+	pvc, err := c.client.Core().PersistentVolumeClaims(c.pvc.Namespace).Get(c.pvc.Name)
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	return pvc.Status.Phase == v1.ClaimBound, nil
+}
+
+type namespaceChecker struct {
+	namespace *v1.Namespace
+	client    *kubernetes.Clientset
+}
+
+func (c *namespaceChecker) Ready(ctx context.Context) (bool, error) {
+	namespace, err := c.client.Core().Namespaces().Get(c.namespace.Name)
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	return namespace.Status.Phase == v1.NamespaceActive, nil
+}
+
+type crdChecker struct {
+	crd    *apiextensionsv1beta1.CustomResourceDefinition
+	client apiextensionsclientset.Interface
+}
+
+func (c *crdChecker) Ready(ctx context.Context) (bool, error) {
+	crd, err := c.client.ApiextensionsV1beta1().CustomResourceDefinitions().Get(c.crd.Name)
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	var established, namesAccepted bool
+	for _, condition := range crd.Status.Conditions {
+		if condition.Status != apiextensionsv1beta1.ConditionTrue {
+			continue
+		}
+		switch condition.Type {
+		case apiextensionsv1beta1.Established:
+			established = true
+		case apiextensionsv1beta1.NamesAccepted:
+			namesAccepted = true
+		}
+	}
+	return established && namesAccepted, nil
+}
@@ -0,0 +1,408 @@
+// Copyright 2016 Gravitational Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rigging
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/gravitational/trace"
+	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	apiextensionsclientset "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api"
+	"k8s.io/client-go/pkg/api/v1"
+	appsv1beta1 "k8s.io/client-go/pkg/apis/apps/v1beta1"
+	batchv1 "k8s.io/client-go/pkg/apis/batch/v1"
+	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+	"k8s.io/client-go/pkg/apis/rbac/v1alpha1"
+)
+
+// Controller is the common surface every resource-specific control (e.g.
+// DeploymentControl) implements, letting callers operate on a resource
+// without knowing its concrete kind.
+type Controller interface {
+	// Upsert creates the resource or updates it if it already exists.
+	Upsert(ctx context.Context) error
+	// Delete deletes the resource per opts.
+	Delete(ctx context.Context, opts DeleteOptions) error
+	// Status blocks until the resource reports ready or the retry
+	// budget is exhausted.
+	Status(ctx context.Context, retryAttempts int, retryPeriod time.Duration) error
+}
+
+// ControlFor returns the Controller matching obj's concrete type. A
+// Deployment gets a DeploymentControl; every other kind gets a
+// genericControl backed directly by its clientset accessor, with Status
+// deferring to the Checker NewCheckerFor returns for that kind. Kinds
+// NewCheckerFor has no Checker for (ConfigMap, Secret, ServiceAccount,
+// RBAC, PodSecurityPolicy, ReplicationController) fail Status with an
+// error.
+//
+// apiExtClient is only consulted for CustomResourceDefinition, which
+// lives in the apiextensions API group rather than *kubernetes.Clientset;
+// it may be nil if the caller never hands ControlFor a CRD.
+func ControlFor(obj runtime.Object, client *kubernetes.Clientset, apiExtClient apiextensionsclientset.Interface) (Controller, error) {
+	switch o := obj.(type) {
+	case *v1beta1.Deployment:
+		return NewDeploymentControl(DeploymentConfig{Deployment: o, Client: client})
+	case *v1.Namespace:
+		resource := client.Core().Namespaces()
+		return &genericControl{
+			client: client,
+			obj:    o,
+			name:   o.Name,
+			get:    func() (runtime.Object, error) { return resource.Get(o.Name) },
+			create: func() error { _, err := resource.Create(o); return err },
+			update: func() error { _, err := resource.Update(o); return err },
+			del:    func(opts *api.DeleteOptions) error { return resource.Delete(o.Name, opts) },
+		}, nil
+	case *apiextensionsv1beta1.CustomResourceDefinition:
+		if apiExtClient == nil {
+			return nil, trace.BadParameter("apiextensions client is required to control CustomResourceDefinition %v", o.Name)
+		}
+		resource := apiExtClient.ApiextensionsV1beta1().CustomResourceDefinitions()
+		return &genericControl{
+			apiExtClient: apiExtClient,
+			obj:          o,
+			name:         o.Name,
+			get:          func() (runtime.Object, error) { return resource.Get(o.Name) },
+			create:       func() error { _, err := resource.Create(o); return err },
+			update:       func() error { _, err := resource.Update(o); return err },
+			del:          func(opts *api.DeleteOptions) error { return resource.Delete(o.Name, opts) },
+		}, nil
+	case *v1beta1.DaemonSet:
+		resource := client.Extensions().DaemonSets(o.Namespace)
+		return &genericControl{
+			client: client,
+			obj:    o,
+			name:   o.Name,
+			get:    func() (runtime.Object, error) { return resource.Get(o.Name) },
+			create: func() error { _, err := resource.Create(o); return err },
+			update: func() error { _, err := resource.Update(o); return err },
+			del:    func(opts *api.DeleteOptions) error { return resource.Delete(o.Name, opts) },
+		}, nil
+	case *appsv1beta1.StatefulSet:
+		resource := client.Apps().StatefulSets(o.Namespace)
+		return &genericControl{
+			client: client,
+			obj:    o,
+			name:   o.Name,
+			get:    func() (runtime.Object, error) { return resource.Get(o.Name) },
+			create: func() error { _, err := resource.Create(o); return err },
+			update: func() error { _, err := resource.Update(o); return err },
+			del:    func(opts *api.DeleteOptions) error { return resource.Delete(o.Name, opts) },
+		}, nil
+	case *v1beta1.ReplicaSet:
+		resource := client.Extensions().ReplicaSets(o.Namespace)
+		return &genericControl{
+			client: client,
+			obj:    o,
+			name:   o.Name,
+			get:    func() (runtime.Object, error) { return resource.Get(o.Name) },
+			create: func() error { _, err := resource.Create(o); return err },
+			update: func() error { _, err := resource.Update(o); return err },
+			del:    func(opts *api.DeleteOptions) error { return resource.Delete(o.Name, opts) },
+		}, nil
+	case *batchv1.Job:
+		resource := client.Batch().Jobs(o.Namespace)
+		return &genericControl{
+			client: client,
+			obj:    o,
+			name:   o.Name,
+			get:    func() (runtime.Object, error) { return resource.Get(o.Name) },
+			create: func() error { _, err := resource.Create(o); return err },
+			update: func() error { _, err := resource.Update(o); return err },
+			del:    func(opts *api.DeleteOptions) error { return resource.Delete(o.Name, opts) },
+		}, nil
+	case *v1.ReplicationController:
+		resource := client.Core().ReplicationControllers(o.Namespace)
+		return &genericControl{
+			client: client,
+			obj:    o,
+			name:   o.Name,
+			get:    func() (runtime.Object, error) { return resource.Get(o.Name) },
+			create: func() error { _, err := resource.Create(o); return err },
+			update: func() error { _, err := resource.Update(o); return err },
+			del:    func(opts *api.DeleteOptions) error { return resource.Delete(o.Name, opts) },
+		}, nil
+	case *v1.Service:
+		resource := client.Core().Services(o.Namespace)
+		return &genericControl{
+			client: client,
+			obj:    o,
+			name:   o.Name,
+			get:    func() (runtime.Object, error) { return resource.Get(o.Name) },
+			create: func() error { _, err := resource.Create(o); return err },
+			update: func() error { _, err := resource.Update(o); return err },
+			del:    func(opts *api.DeleteOptions) error { return resource.Delete(o.Name, opts) },
+		}, nil
+	case *v1.ConfigMap:
+		resource := client.Core().ConfigMaps(o.Namespace)
+		return &genericControl{
+			client: client,
+			obj:    o,
+			name:   o.Name,
+			get:    func() (runtime.Object, error) { return resource.Get(o.Name) },
+			create: func() error { _, err := resource.Create(o); return err },
+			update: func() error { _, err := resource.Update(o); return err },
+			del:    func(opts *api.DeleteOptions) error { return resource.Delete(o.Name, opts) },
+		}, nil
+	case *v1.Secret:
+		resource := client.Core().Secrets(o.Namespace)
+		return &genericControl{
+			client: client,
+			obj:    o,
+			name:   o.Name,
+			get:    func() (runtime.Object, error) { return resource.Get(o.Name) },
+			create: func() error { _, err := resource.Create(o); return err },
+			update: func() error { _, err := resource.Update(o); return err },
+			del:    func(opts *api.DeleteOptions) error { return resource.Delete(o.Name, opts) },
+		}, nil
+	case *v1.ServiceAccount:
+		resource := client.Core().ServiceAccounts(o.Namespace)
+		return &genericControl{
+			client: client,
+			obj:    o,
+			name:   o.Name,
+			get:    func() (runtime.Object, error) { return resource.Get(o.Name) },
+			create: func() error { _, err := resource.Create(o); return err },
+			update: func() error { _, err := resource.Update(o); return err },
+			del:    func(opts *api.DeleteOptions) error { return resource.Delete(o.Name, opts) },
+		}, nil
+	case *v1.PersistentVolumeClaim:
+		resource := client.Core().PersistentVolumeClaims(o.Namespace)
+		return &genericControl{
+			client: client,
+			obj:    o,
+			name:   o.Name,
+			get:    func() (runtime.Object, error) { return resource.Get(o.Name) },
+			create: func() error { _, err := resource.Create(o); return err },
+			update: func() error { _, err := resource.Update(o); return err },
+			del:    func(opts *api.DeleteOptions) error { return resource.Delete(o.Name, opts) },
+		}, nil
+	case *v1.Pod:
+		resource := client.Core().Pods(o.Namespace)
+		return &genericControl{
+			client: client,
+			obj:    o,
+			name:   o.Name,
+			get:    func() (runtime.Object, error) { return resource.Get(o.Name) },
+			create: func() error { _, err := resource.Create(o); return err },
+			update: func() error { _, err := resource.Update(o); return err },
+			del:    func(opts *api.DeleteOptions) error { return resource.Delete(o.Name, opts) },
+		}, nil
+	case *v1alpha1.Role:
+		resource := client.Rbac().Roles(o.Namespace)
+		return &genericControl{
+			client: client,
+			obj:    o,
+			name:   o.Name,
+			get:    func() (runtime.Object, error) { return resource.Get(o.Name) },
+			create: func() error { _, err := resource.Create(o); return err },
+			update: func() error { _, err := resource.Update(o); return err },
+			del:    func(opts *api.DeleteOptions) error { return resource.Delete(o.Name, opts) },
+		}, nil
+	case *v1alpha1.ClusterRole:
+		resource := client.Rbac().ClusterRoles()
+		return &genericControl{
+			client: client,
+			obj:    o,
+			name:   o.Name,
+			get:    func() (runtime.Object, error) { return resource.Get(o.Name) },
+			create: func() error { _, err := resource.Create(o); return err },
+			update: func() error { _, err := resource.Update(o); return err },
+			del:    func(opts *api.DeleteOptions) error { return resource.Delete(o.Name, opts) },
+		}, nil
+	case *v1alpha1.RoleBinding:
+		resource := client.Rbac().RoleBindings(o.Namespace)
+		return &genericControl{
+			client: client,
+			obj:    o,
+			name:   o.Name,
+			get:    func() (runtime.Object, error) { return resource.Get(o.Name) },
+			create: func() error { _, err := resource.Create(o); return err },
+			update: func() error { _, err := resource.Update(o); return err },
+			del:    func(opts *api.DeleteOptions) error { return resource.Delete(o.Name, opts) },
+		}, nil
+	case *v1alpha1.ClusterRoleBinding:
+		resource := client.Rbac().ClusterRoleBindings()
+		return &genericControl{
+			client: client,
+			obj:    o,
+			name:   o.Name,
+			get:    func() (runtime.Object, error) { return resource.Get(o.Name) },
+			create: func() error { _, err := resource.Create(o); return err },
+			update: func() error { _, err := resource.Update(o); return err },
+			del:    func(opts *api.DeleteOptions) error { return resource.Delete(o.Name, opts) },
+		}, nil
+	case *v1beta1.PodSecurityPolicy:
+		resource := client.Extensions().PodSecurityPolicies()
+		return &genericControl{
+			client: client,
+			obj:    o,
+			name:   o.Name,
+			get:    func() (runtime.Object, error) { return resource.Get(o.Name) },
+			create: func() error { _, err := resource.Create(o); return err },
+			update: func() error { _, err := resource.Update(o); return err },
+			del:    func(opts *api.DeleteOptions) error { return resource.Delete(o.Name, opts) },
+		}, nil
+	default:
+		return nil, trace.BadParameter("no controller is registered for %T", obj)
+	}
+}
+
+// kindUpsertOrder ranks kinds in the order they must be applied so that
+// dependencies (namespaces, CRDs, RBAC) exist before the resources that
+// rely on them. Every kind ControlFor handles must have an entry here;
+// UpsertAll refuses to guess at a rank for one that doesn't.
+var kindUpsertOrder = map[string]int{
+	KindNamespace:                0,
+	KindCustomResourceDefinition: 1,
+	KindServiceAccount:           2,
+	KindRole:                     2,
+	KindClusterRole:              2,
+	KindRoleBinding:              2,
+	KindClusterRoleBinding:       2,
+	KindPodSecurityPolicy:        2,
+	KindConfigMap:                3,
+	KindSecret:                   3,
+	KindPersistentVolumeClaim:    3,
+	KindDeployment:               4,
+	KindDaemonSet:                4,
+	KindStatefulSet:              4,
+	KindReplicationController:    4,
+	KindReplicaSet:               4,
+	KindJob:                      4,
+	KindService:                  4,
+	KindPod:                      5,
+}
+
+// UpsertAll applies objs in dependency order (namespaces, then CRDs,
+// then RBAC, then ConfigMaps/Secrets, then workloads), so a whole
+// manifest can be applied without the caller having to sequence it by
+// hand. apiExtClient is only consulted when objs contains a
+// CustomResourceDefinition and may be nil otherwise.
+func UpsertAll(ctx context.Context, objs []runtime.Object, client *kubernetes.Clientset, apiExtClient apiextensionsclientset.Interface) error {
+	ordered := make([]runtime.Object, len(objs))
+	copy(ordered, objs)
+	var sortErr error
+	sort.SliceStable(ordered, func(i, j int) bool {
+		rankI, ok := kindUpsertOrder[kindOf(ordered[i])]
+		if !ok {
+			sortErr = trace.BadParameter("no upsert rank is registered for kind %q", kindOf(ordered[i]))
+		}
+		rankJ, ok := kindUpsertOrder[kindOf(ordered[j])]
+		if !ok {
+			sortErr = trace.BadParameter("no upsert rank is registered for kind %q", kindOf(ordered[j]))
+		}
+		return rankI < rankJ
+	})
+	if sortErr != nil {
+		return sortErr
+	}
+	for _, obj := range ordered {
+		control, err := ControlFor(obj, client, apiExtClient)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		if err := control.Upsert(ctx); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// kindOf returns the TypeMeta.Kind of obj.
+func kindOf(obj runtime.Object) string {
+	return obj.GetObjectKind().GroupVersionKind().Kind
+}
+
+// genericControl adapts a resource that has no dedicated control of its
+// own to the Controller interface, driving Upsert/Delete through the
+// clientset accessor closures supplied by ControlFor and deferring
+// Status to the Checker registered for its kind.
+type genericControl struct {
+	client       *kubernetes.Clientset
+	apiExtClient apiextensionsclientset.Interface
+	obj          runtime.Object
+	name         string
+	get          func() (runtime.Object, error)
+	create       func() error
+	update       func() error
+	del          func(opts *api.DeleteOptions) error
+}
+
+// Upsert creates the resource, or updates it if it already exists,
+// mirroring DeploymentControl.Upsert.
+func (c *genericControl) Upsert(ctx context.Context) error {
+	_, err := c.get()
+	err = convertErr(err)
+	if err != nil {
+		if !trace.IsNotFound(err) {
+			return trace.Wrap(err)
+		}
+		return trace.Wrap(c.create())
+	}
+	return trace.Wrap(c.update())
+}
+
+// Delete deletes the resource with the given cascading policy, blocking
+// until it's gone when opts.Propagation is Foreground.
+func (c *genericControl) Delete(ctx context.Context, opts DeleteOptions) error {
+	policy := opts.Propagation.toK8s()
+	err := convertErr(c.del(&api.DeleteOptions{PropagationPolicy: &policy}))
+	if err != nil {
+		if trace.IsNotFound(err) {
+			return nil
+		}
+		return trace.Wrap(err)
+	}
+	if policy != metav1.DeletePropagationForeground {
+		return nil
+	}
+	return pollUntilNotFound(ctx, func() error {
+		_, err := c.get()
+		return convertErr(err)
+	})
+}
+
+// Status polls the Checker registered for this resource's kind until it
+// reports ready or the retry budget is exhausted.
+func (c *genericControl) Status(ctx context.Context, retryAttempts int, retryPeriod time.Duration) error {
+	if retryAttempts == 0 {
+		retryAttempts = DefaultRetryAttempts
+	}
+	if retryPeriod == 0 {
+		retryPeriod = DefaultRetryPeriod
+	}
+	return retry(ctx, retryAttempts, retryPeriod, func() error {
+		checker, err := NewCheckerFor(c.obj, c.client, c.apiExtClient)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		ready, err := checker.Ready(ctx)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		if !ready {
+			return trace.CompareFailed("%v is not ready yet", c.name)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,86 @@
+// Copyright 2016 Gravitational Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rigging
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+)
+
+// TestKindUpsertOrderCoversAllControlledKinds guards against the class of
+// bug where a kind ControlFor knows how to handle has no entry in
+// kindUpsertOrder: UpsertAll's sort fails on such a kind with a "no
+// upsert rank is registered" error instead of applying the manifest.
+func TestKindUpsertOrderCoversAllControlledKinds(t *testing.T) {
+	kinds := []string{
+		KindDeployment,
+		KindNamespace,
+		KindCustomResourceDefinition,
+		KindDaemonSet,
+		KindStatefulSet,
+		KindReplicaSet,
+		KindJob,
+		KindReplicationController,
+		KindService,
+		KindConfigMap,
+		KindSecret,
+		KindServiceAccount,
+		KindPersistentVolumeClaim,
+		KindPod,
+		KindRole,
+		KindClusterRole,
+		KindRoleBinding,
+		KindClusterRoleBinding,
+		KindPodSecurityPolicy,
+	}
+	for _, kind := range kinds {
+		if _, ok := kindUpsertOrder[kind]; !ok {
+			t.Errorf("kindUpsertOrder has no entry for %v, which ControlFor handles", kind)
+		}
+	}
+}
+
+// TestUpsertOrderSortsDependenciesFirst reproduces the ordering example
+// from the upsert-order review comment: a Pod that mounts a ConfigMap
+// must not be created before the ConfigMap or the CustomResourceDefinition
+// it may depend on.
+func TestUpsertOrderSortsDependenciesFirst(t *testing.T) {
+	objs := []runtime.Object{
+		&v1beta1.Deployment{TypeMeta: metav1.TypeMeta{Kind: KindDeployment}},
+		&v1.ConfigMap{TypeMeta: metav1.TypeMeta{Kind: KindConfigMap}},
+		&v1.Pod{TypeMeta: metav1.TypeMeta{Kind: KindPod}},
+		&apiextensionsv1beta1.CustomResourceDefinition{TypeMeta: metav1.TypeMeta{Kind: KindCustomResourceDefinition}},
+	}
+	ordered := make([]runtime.Object, len(objs))
+	copy(ordered, objs)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return kindUpsertOrder[kindOf(ordered[i])] < kindUpsertOrder[kindOf(ordered[j])]
+	})
+	var kinds []string
+	for _, obj := range ordered {
+		kinds = append(kinds, kindOf(obj))
+	}
+	expected := []string{KindCustomResourceDefinition, KindConfigMap, KindDeployment, KindPod}
+	if !reflect.DeepEqual(kinds, expected) {
+		t.Errorf("expected upsert order %v, got %v", expected, kinds)
+	}
+}
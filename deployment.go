@@ -18,18 +18,110 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"strings"
+	"math/rand"
+	"net/http"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/gravitational/trace"
-	"k8s.io/client-go/1.4/kubernetes"
-	"k8s.io/client-go/1.4/pkg/api"
-	"k8s.io/client-go/1.4/pkg/api/v1"
-	"k8s.io/client-go/1.4/pkg/apis/extensions/v1beta1"
-	"k8s.io/client-go/1.4/pkg/labels"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
 )
 
+// RolloutStatus describes the current state of a rollout as derived from
+// the resource's generation and status conditions.
+//
+// deploymentRolloutStatus below is the Deployment instance of this
+// algorithm. This codebase has no dedicated DaemonSetControl or
+// StatefulSetControl to give the DaemonSet/StatefulSet instances a home,
+// so their generation/condition checks (ObservedGeneration vs
+// Generation, then DesiredNumberScheduled/UpdatedNumberScheduled/
+// NumberAvailable for DaemonSet, CurrentRevision/UpdateRevision for
+// StatefulSet) live on daemonSetChecker and statefulSetChecker in
+// checker.go instead, reachable through NewCheckerFor.
+type RolloutStatus string
+
+const (
+	// RolloutStatusProgressing means the rollout is still in progress
+	// and the caller should keep waiting.
+	RolloutStatusProgressing RolloutStatus = "progressing"
+	// RolloutStatusComplete means the rollout has finished successfully.
+	RolloutStatusComplete RolloutStatus = "complete"
+	// RolloutStatusFailed means the rollout has permanently failed and
+	// retrying will not help.
+	RolloutStatusFailed RolloutStatus = "failed"
+)
+
+// ProgressDeadlineExceeded is the reason reported on the Progressing
+// condition once a Deployment's progressDeadlineSeconds has elapsed
+// without progress.
+const ProgressDeadlineExceeded = "ProgressDeadlineExceeded"
+
+// PropagationPolicy controls how a delete cascades to a resource's
+// dependents, mirroring metav1.DeletionPropagation.
+type PropagationPolicy string
+
+const (
+	// PropagationForeground blocks the delete until all dependents
+	// are gone.
+	PropagationForeground PropagationPolicy = "Foreground"
+	// PropagationBackground deletes the resource immediately and
+	// garbage-collects dependents in the background.
+	PropagationBackground PropagationPolicy = "Background"
+	// PropagationOrphan deletes the resource but leaves its
+	// dependents in place.
+	PropagationOrphan PropagationPolicy = "Orphan"
+)
+
+// toK8s converts p to the equivalent metav1.DeletionPropagation,
+// defaulting to background propagation.
+func (p PropagationPolicy) toK8s() metav1.DeletionPropagation {
+	switch p {
+	case PropagationForeground:
+		return metav1.DeletePropagationForeground
+	case PropagationOrphan:
+		return metav1.DeletePropagationOrphan
+	default:
+		return metav1.DeletePropagationBackground
+	}
+}
+
+// DeleteOptions controls how a resource delete is carried out.
+type DeleteOptions struct {
+	// Propagation is the cascading delete policy applied to the
+	// resource's dependents.
+	Propagation PropagationPolicy
+}
+
+// pollUntilNotFound calls get every DefaultRetryPeriod until it reports
+// NotFound, ctx is cancelled or its deadline is exceeded.
+func pollUntilNotFound(ctx context.Context, get func() error) error {
+	ticker := time.NewTicker(DefaultRetryPeriod)
+	defer ticker.Stop()
+	for {
+		err := get()
+		if trace.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		select {
+		case <-ctx.Done():
+			return trace.Wrap(ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
 // NewDeploymentControl returns new instance of Deployment updater
 func NewDeploymentControl(config DeploymentConfig) (*DeploymentControl, error) {
 	err := config.CheckAndSetDefaults()
@@ -63,6 +155,13 @@ type DeploymentConfig struct {
 	Deployment *v1beta1.Deployment
 	// Client is k8s client
 	Client *kubernetes.Clientset
+	// UseWatch makes WaitReady watch for rollout progress instead of
+	// polling Status in a loop. Existing callers of Status are
+	// unaffected.
+	UseWatch bool
+	// WatchTimeout bounds how long WaitReady waits for the rollout to
+	// finish when UseWatch is set. Defaults to DefaultWatchTimeout.
+	WatchTimeout time.Duration
 }
 
 func (c *DeploymentConfig) CheckAndSetDefaults() error {
@@ -83,70 +182,87 @@ type DeploymentControl struct {
 	*log.Entry
 }
 
-// collectPods returns pods created by this RC
+// collectPods returns pods created by this deployment. Deployments don't
+// own pods directly - they own ReplicaSets, which in turn own the pods -
+// so this walks the owner reference chain rather than relying on the
+// legacy kubernetes.io/created-by annotation, which was removed from
+// modern Kubernetes and never described Deployment-owned pods correctly
+// in the first place.
 func (c *DeploymentControl) collectPods(deployment *v1beta1.Deployment) ([]v1.Pod, error) {
-	set := make(labels.Set)
-	if c.deployment.Spec.Selector != nil {
-		for key, val := range c.deployment.Spec.Selector.MatchLabels {
-			set[key] = val
+	selector := c.podSelector()
+	replicaSets := c.Client.Extensions().ReplicaSets(deployment.Namespace)
+	rsList, err := replicaSets.List(api.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	rsUIDs := make(map[types.UID]bool)
+	for _, rs := range rsList.Items {
+		if isOwnedBy(rs.OwnerReferences, deployment.UID, KindDeployment) {
+			rsUIDs[rs.UID] = true
 		}
 	}
 	pods := c.Client.Core().Pods(deployment.Namespace)
-	podList, err := pods.List(api.ListOptions{
-		LabelSelector: set.AsSelector(),
-	})
+	podList, err := pods.List(api.ListOptions{LabelSelector: selector})
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
-	c.Infof("collectPods(%v) -> %v", set, len(podList.Items))
 	currentPods := make([]v1.Pod, 0)
 	for _, pod := range podList.Items {
-		createdBy, ok := pod.Annotations[AnnotationCreatedBy]
-		if !ok {
-			continue
-		}
-		ref, err := ParseSerializedReference(strings.NewReader(createdBy))
-		if err != nil {
-			log.Warningf(trace.DebugReport(err))
-			continue
-		}
-		c.Infof("collectPods(%v, %v, %v)", ref.Reference.Kind, ref.Reference.UID, deployment.UID)
-		if ref.Reference.Kind == KindDeployment && ref.Reference.UID == deployment.UID {
+		if isOwnedByAny(pod.OwnerReferences, rsUIDs, KindReplicaSet) {
 			currentPods = append(currentPods, pod)
-			c.Infof("found pod created by this RC: %v", pod.Name)
+			c.Infof("found pod created by this deployment: %v", pod.Name)
 		}
 	}
+	c.Infof("collectPods(%v) -> %v", deployment.Name, len(currentPods))
 	return currentPods, nil
 }
 
-func (c *DeploymentControl) Delete(ctx context.Context, cascade bool) error {
-	c.Infof("Delete")
-	rcs := c.Client.Extensions().Deployments(c.deployment.Namespace)
-	currentDeployment, err := rcs.Get(c.deployment.Name)
-	if err != nil {
-		return trace.Wrap(err)
+// isOwnedBy returns true if refs contains a reference of the given kind
+// pointing at uid.
+func isOwnedBy(refs []metav1.OwnerReference, uid types.UID, kind string) bool {
+	for _, ref := range refs {
+		if ref.Kind == kind && ref.UID == uid {
+			return true
+		}
 	}
-	pods := c.Client.Core().Pods(c.deployment.Namespace)
-	currentPods, err := c.collectPods(currentDeployment)
-	if err != nil {
-		return trace.Wrap(err)
+	return false
+}
+
+// isOwnedByAny returns true if refs contains a reference of the given
+// kind whose UID is present in uids.
+func isOwnedByAny(refs []metav1.OwnerReference, uids map[types.UID]bool, kind string) bool {
+	for _, ref := range refs {
+		if ref.Kind == kind && uids[ref.UID] {
+			return true
+		}
 	}
-	c.Infof("deleting")
-	err = rcs.Delete(c.deployment.Name, nil)
+	return false
+}
+
+// Delete deletes the deployment, letting the API server cascade the
+// delete to its ReplicaSets and Pods per opts.Propagation, rather than
+// racing a manual pod-by-pod delete against the ReplicaSet controller
+// creating replacements.
+func (c *DeploymentControl) Delete(ctx context.Context, opts DeleteOptions) error {
+	c.Infof("Delete")
+	rcs := c.Client.Extensions().Deployments(c.deployment.Namespace)
+	policy := opts.Propagation.toK8s()
+	err := rcs.Delete(c.deployment.Name, &api.DeleteOptions{PropagationPolicy: &policy})
+	err = convertErr(err)
 	if err != nil {
+		if trace.IsNotFound(err) {
+			return nil
+		}
 		return trace.Wrap(err)
 	}
-	if !cascade {
-		c.Infof("cascade not set, returning")
-	}
-	c.Infof("deleting pods %v", len(currentPods))
-	for _, pod := range currentPods {
-		log.Infof("deleting pod %v", pod.Name)
-		if err := pods.Delete(pod.Name, nil); err != nil {
-			return trace.Wrap(err)
-		}
+	if policy != metav1.DeletePropagationForeground {
+		return nil
 	}
-	return nil
+	c.Infof("waiting for deployment %v to be removed", c.deployment.Name)
+	return pollUntilNotFound(ctx, func() error {
+		_, err := rcs.Get(c.deployment.Name)
+		return convertErr(err)
+	})
 }
 
 func (c *DeploymentControl) Upsert(ctx context.Context) error {
@@ -185,28 +301,295 @@ func (c *DeploymentControl) Status(ctx context.Context, retryAttempts int, retry
 	}
 	c.Infof("Checking status retryAttempts=%v, retryPeriod=%v", retryAttempts, retryPeriod)
 
-	return retry(ctx, retryAttempts, retryPeriod, func() error {
-		rcs := c.Client.Extensions().Deployments(c.deployment.Namespace)
-		currentDeployment, err := rcs.Get(c.deployment.Name)
-		if err != nil {
+	var failed error
+	err := retry(ctx, retryAttempts, retryPeriod, func() error {
+		status, err := c.RolloutStatus(ctx)
+		if err != nil && status != RolloutStatusFailed {
 			return trace.Wrap(err)
 		}
-		var replicas int32 = 1
-		if currentDeployment.Spec.Replicas != nil {
-			replicas = *(currentDeployment.Spec.Replicas)
+		switch status {
+		case RolloutStatusFailed:
+			// Rollout has permanently failed, stop retrying but
+			// surface the failure to the caller below.
+			failed = trace.Wrap(err)
+			return nil
+		case RolloutStatusProgressing:
+			return trace.CompareFailed("deployment %v is still progressing", c.deployment.Name)
 		}
-		if currentDeployment.Status.UpdatedReplicas != replicas {
-			return trace.CompareFailed("expected replicas: %v, ready: %v", replicas, currentDeployment.Status.UpdatedReplicas)
+		return nil
+	})
+	if failed != nil {
+		return failed
+	}
+	return err
+}
+
+// RolloutStatus returns the current rollout status of the deployment,
+// distinguishing a transient in-progress rollout from one that has
+// permanently failed.
+func (c *DeploymentControl) RolloutStatus(ctx context.Context) (RolloutStatus, error) {
+	rcs := c.Client.Extensions().Deployments(c.deployment.Namespace)
+	currentDeployment, err := rcs.Get(c.deployment.Name)
+	if err != nil {
+		return RolloutStatusProgressing, trace.Wrap(err)
+	}
+	status, err := deploymentRolloutStatus(currentDeployment)
+	if err != nil {
+		return status, trace.Wrap(err)
+	}
+	if status == RolloutStatusProgressing {
+		c.logPodStatus(currentDeployment)
+	}
+	return status, nil
+}
+
+// logPodStatus collects the deployment's pods via their ownerReferences
+// and logs each one's phase, to help diagnose why a rollout is still
+// progressing.
+func (c *DeploymentControl) logPodStatus(deployment *v1beta1.Deployment) {
+	pods, err := c.collectPods(deployment)
+	if err != nil {
+		log.Warningf(trace.DebugReport(err))
+		return
+	}
+	for _, pod := range pods {
+		c.Infof("pod %v phase=%v", pod.Name, pod.Status.Phase)
+	}
+}
+
+// deploymentRolloutStatus derives the rollout status of the deployment
+// from its observed generation and status conditions, following the same
+// algorithm `kubectl rollout status` and Helm use to decide whether a
+// Deployment update has finished, is still progressing or has failed.
+func deploymentRolloutStatus(deployment *v1beta1.Deployment) (RolloutStatus, error) {
+	if deployment.Status.ObservedGeneration < deployment.Generation {
+		return RolloutStatusProgressing, nil
+	}
+	for _, condition := range deployment.Status.Conditions {
+		if condition.Type == v1beta1.DeploymentProgressing && condition.Reason == ProgressDeadlineExceeded {
+			return RolloutStatusFailed, trace.BadParameter(condition.Message)
 		}
-		pods, err := c.collectPods(currentDeployment)
-		if err != nil {
-			return trace.Wrap(err)
+	}
+	var replicas int32 = 1
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	if deployment.Status.UpdatedReplicas != replicas {
+		return RolloutStatusProgressing, nil
+	}
+	if deployment.Status.Replicas != deployment.Status.UpdatedReplicas {
+		return RolloutStatusProgressing, nil
+	}
+	maxUnavailable, err := deploymentMaxUnavailable(deployment, replicas)
+	if err != nil {
+		return RolloutStatusProgressing, trace.Wrap(err)
+	}
+	if deployment.Status.AvailableReplicas < replicas-maxUnavailable {
+		return RolloutStatusProgressing, nil
+	}
+	return RolloutStatusComplete, nil
+}
+
+// deploymentMaxUnavailable computes the number of unavailable replicas
+// tolerated during a rolling update, resolving the percent-or-absolute
+// value from the deployment's rolling update strategy.
+func deploymentMaxUnavailable(deployment *v1beta1.Deployment, replicas int32) (int32, error) {
+	if deployment.Spec.Strategy.Type == v1beta1.RecreateDeploymentStrategyType || replicas == 0 {
+		return 0, nil
+	}
+	rollingUpdate := deployment.Spec.Strategy.RollingUpdate
+	if rollingUpdate == nil || rollingUpdate.MaxUnavailable == nil {
+		return 0, nil
+	}
+	maxUnavailable, err := intstr.GetValueFromIntOrPercent(rollingUpdate.MaxUnavailable, int(replicas), false)
+	if err != nil {
+		return 0, trace.Wrap(err)
+	}
+	return int32(maxUnavailable), nil
+}
+
+// DefaultWatchTimeout is how long WaitReady waits for a rollout to
+// finish when DeploymentConfig.UseWatch is set and WatchTimeout is zero.
+const DefaultWatchTimeout = 10 * time.Minute
+
+// errWatchExpired is returned internally when a watch's result channel
+// closes, which the apiserver does periodically (and always once the
+// watch's resourceVersion becomes too old, i.e. "410 Gone").
+var errWatchExpired = trace.BadParameter("watch expired")
+
+// rolloutFailedError wraps a permanent rollout failure (e.g.
+// ProgressDeadlineExceeded) so WaitReady can tell it apart from a
+// transient watch/connection error and return it immediately instead of
+// retrying with backoff.
+type rolloutFailedError struct {
+	error
+}
+
+// WaitReady blocks until the deployment's rollout completes, fails
+// permanently, or ctx is done. Unlike Status, which polls Get on a fixed
+// period, WaitReady reacts to deployment and pod watch events and is
+// cheaper at scale and quicker to notice readiness.
+func (c *DeploymentControl) WaitReady(ctx context.Context) error {
+	if !c.UseWatch {
+		return c.Status(ctx, 0, 0)
+	}
+	timeout := c.WatchTimeout
+	if timeout == 0 {
+		timeout = DefaultWatchTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	backoff := DefaultRetryPeriod
+	for {
+		ready, err := c.watchOnce(ctx)
+		if ready {
+			return nil
 		}
-		for _, pod := range pods {
-			if pod.Status.Phase != v1.PodRunning {
-				return trace.CompareFailed("pod %v is not running yet: %v", pod.Name, pod.Status.Phase)
-			}
+		if failed, ok := err.(*rolloutFailedError); ok {
+			// The rollout has permanently failed, retrying won't help.
+			return trace.Wrap(failed.error)
 		}
-		return nil
+		if err == nil || err == errWatchExpired {
+			c.Infof("watch expired, re-listing")
+			backoff = DefaultRetryPeriod
+			continue
+		}
+		if ctx.Err() != nil {
+			return trace.Wrap(ctx.Err())
+		}
+		c.Warningf("watch error, retrying in %v: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			return trace.Wrap(ctx.Err())
+		case <-time.After(jitter(backoff)):
+		}
+		backoff = nextBackoff(backoff)
+	}
+}
+
+// watchOnce opens a watch on the deployment and a watch on its pods,
+// seeded with the current ResourceVersion, and evaluates the rollout
+// predicate on every event until the rollout completes, fails, a watch
+// closes or reports "410 Gone" (ready=false, err=errWatchExpired), or ctx
+// is done.
+func (c *DeploymentControl) watchOnce(ctx context.Context) (bool, error) {
+	deployments := c.Client.Extensions().Deployments(c.deployment.Namespace)
+	current, err := deployments.Get(c.deployment.Name)
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	if ready, err := evaluateRollout(current); ready || err != nil {
+		return ready, err
+	}
+
+	deploymentWatch, err := deployments.Watch(api.ListOptions{
+		FieldSelector:   fields.OneTermEqualSelector("metadata.name", c.deployment.Name),
+		ResourceVersion: current.ResourceVersion,
+	})
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	defer deploymentWatch.Stop()
+
+	podWatch, err := c.Client.Core().Pods(c.deployment.Namespace).Watch(api.ListOptions{
+		LabelSelector:   c.podSelector(),
+		ResourceVersion: current.ResourceVersion,
 	})
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	defer podWatch.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false, trace.Wrap(ctx.Err())
+		case event, ok := <-deploymentWatch.ResultChan():
+			if !ok {
+				return false, errWatchExpired
+			}
+			if event.Type == watch.Error {
+				return false, errFromWatchEvent(event)
+			}
+			deployment, isDeployment := event.Object.(*v1beta1.Deployment)
+			if !isDeployment {
+				continue
+			}
+			if ready, err := evaluateRollout(deployment); ready || err != nil {
+				return ready, err
+			}
+		case event, ok := <-podWatch.ResultChan():
+			if !ok {
+				return false, errWatchExpired
+			}
+			if event.Type == watch.Error {
+				return false, errFromWatchEvent(event)
+			}
+			// A pod changed state; re-check the deployment's own
+			// rollout status, which is the source of truth.
+			current, err := deployments.Get(c.deployment.Name)
+			if err != nil {
+				return false, trace.Wrap(err)
+			}
+			if ready, err := evaluateRollout(current); ready || err != nil {
+				return ready, err
+			}
+		}
+	}
+}
+
+// podSelector returns the label selector matching pods managed by this
+// deployment's template selector.
+func (c *DeploymentControl) podSelector() labels.Selector {
+	set := make(labels.Set)
+	if c.deployment.Spec.Selector != nil {
+		for key, val := range c.deployment.Spec.Selector.MatchLabels {
+			set[key] = val
+		}
+	}
+	return set.AsSelector()
+}
+
+// evaluateRollout reports whether the deployment's rollout has
+// completed. A permanent failure (RolloutStatusFailed) is returned as a
+// *rolloutFailedError so callers can distinguish it from a transient
+// error and skip retrying.
+func evaluateRollout(deployment *v1beta1.Deployment) (bool, error) {
+	status, err := deploymentRolloutStatus(deployment)
+	if status == RolloutStatusFailed {
+		return false, &rolloutFailedError{trace.BadParameter("deployment %v has failed to roll out", deployment.Name)}
+	}
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	return status == RolloutStatusComplete, nil
+}
+
+// errFromWatchEvent extracts an error from a watch.Error event. A "410
+// Gone" status is reported as errWatchExpired so the caller re-lists.
+func errFromWatchEvent(event watch.Event) error {
+	if status, ok := event.Object.(*metav1.Status); ok {
+		if status.Code == http.StatusGone {
+			return errWatchExpired
+		}
+		return trace.BadParameter("watch error: %v", status.Message)
+	}
+	return trace.BadParameter("watch error: %v", event.Object)
+}
+
+// nextBackoff doubles d, capping it at DefaultWatchTimeout so a string
+// of connection errors can't grow the wait unbounded.
+func nextBackoff(d time.Duration) time.Duration {
+	d *= 2
+	if d > DefaultWatchTimeout {
+		return DefaultWatchTimeout
+	}
+	return d
+}
+
+// jitter returns d plus up to 50% random jitter, to avoid every watcher
+// reconnecting in lockstep after a shared apiserver blip.
+func jitter(d time.Duration) time.Duration {
+	return d + time.Duration(rand.Int63n(int64(d)/2+1))
 }
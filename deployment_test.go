@@ -0,0 +1,216 @@
+// Copyright 2016 Gravitational Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rigging
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
+)
+
+func int32ptr(v int32) *int32 {
+	return &v
+}
+
+func TestDeploymentRolloutStatus(t *testing.T) {
+	testCases := []struct {
+		comment string
+		deploy  v1beta1.Deployment
+		status  RolloutStatus
+		wantErr bool
+	}{
+		{
+			comment: "observed generation behind spec generation is still progressing",
+			deploy: v1beta1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Generation: 2},
+				Spec:       v1beta1.DeploymentSpec{Replicas: int32ptr(3)},
+				Status:     v1beta1.DeploymentStatus{ObservedGeneration: 1},
+			},
+			status: RolloutStatusProgressing,
+		},
+		{
+			comment: "ProgressDeadlineExceeded condition is a permanent failure",
+			deploy: v1beta1.Deployment{
+				Spec: v1beta1.DeploymentSpec{Replicas: int32ptr(3)},
+				Status: v1beta1.DeploymentStatus{
+					Conditions: []v1beta1.DeploymentCondition{
+						{
+							Type:    v1beta1.DeploymentProgressing,
+							Reason:  ProgressDeadlineExceeded,
+							Message: "deadline exceeded",
+						},
+					},
+				},
+			},
+			status:  RolloutStatusFailed,
+			wantErr: true,
+		},
+		{
+			comment: "updated replicas short of desired is still progressing",
+			deploy: v1beta1.Deployment{
+				Spec: v1beta1.DeploymentSpec{Replicas: int32ptr(3)},
+				Status: v1beta1.DeploymentStatus{
+					UpdatedReplicas: 2,
+				},
+			},
+			status: RolloutStatusProgressing,
+		},
+		{
+			comment: "old replicas not yet terminated is still progressing",
+			deploy: v1beta1.Deployment{
+				Spec: v1beta1.DeploymentSpec{Replicas: int32ptr(3)},
+				Status: v1beta1.DeploymentStatus{
+					UpdatedReplicas: 3,
+					Replicas:        4,
+				},
+			},
+			status: RolloutStatusProgressing,
+		},
+		{
+			comment: "available replicas below replicas-maxUnavailable is still progressing",
+			deploy: v1beta1.Deployment{
+				Spec: v1beta1.DeploymentSpec{
+					Replicas: int32ptr(4),
+					Strategy: v1beta1.DeploymentStrategy{
+						Type: v1beta1.RollingUpdateDeploymentStrategyType,
+						RollingUpdate: &v1beta1.RollingUpdateDeployment{
+							MaxUnavailable: intOrStringPtr(intstr.FromInt(1)),
+						},
+					},
+				},
+				Status: v1beta1.DeploymentStatus{
+					UpdatedReplicas:   4,
+					Replicas:          4,
+					AvailableReplicas: 2,
+				},
+			},
+			status: RolloutStatusProgressing,
+		},
+		{
+			comment: "all replicas updated and available is complete",
+			deploy: v1beta1.Deployment{
+				Spec: v1beta1.DeploymentSpec{Replicas: int32ptr(3)},
+				Status: v1beta1.DeploymentStatus{
+					UpdatedReplicas:   3,
+					Replicas:          3,
+					AvailableReplicas: 3,
+				},
+			},
+			status: RolloutStatusComplete,
+		},
+	}
+	for _, testCase := range testCases {
+		status, err := deploymentRolloutStatus(&testCase.deploy)
+		if status != testCase.status {
+			t.Errorf("%v: expected status %v, got %v", testCase.comment, testCase.status, status)
+		}
+		if testCase.wantErr && err == nil {
+			t.Errorf("%v: expected an error, got none", testCase.comment)
+		}
+		if !testCase.wantErr && err != nil {
+			t.Errorf("%v: expected no error, got %v", testCase.comment, err)
+		}
+	}
+}
+
+func TestDeploymentMaxUnavailable(t *testing.T) {
+	testCases := []struct {
+		comment  string
+		deploy   v1beta1.Deployment
+		replicas int32
+		expected int32
+	}{
+		{
+			comment: "Recreate strategy has no rolling update budget",
+			deploy: v1beta1.Deployment{
+				Spec: v1beta1.DeploymentSpec{Strategy: v1beta1.DeploymentStrategy{Type: v1beta1.RecreateDeploymentStrategyType}},
+			},
+			replicas: 3,
+			expected: 0,
+		},
+		{
+			comment:  "zero replicas has no rolling update budget",
+			replicas: 0,
+			expected: 0,
+		},
+		{
+			comment: "nil RollingUpdate defaults to 0",
+			deploy: v1beta1.Deployment{
+				Spec: v1beta1.DeploymentSpec{Strategy: v1beta1.DeploymentStrategy{Type: v1beta1.RollingUpdateDeploymentStrategyType}},
+			},
+			replicas: 3,
+			expected: 0,
+		},
+		{
+			comment: "nil MaxUnavailable defaults to 0",
+			deploy: v1beta1.Deployment{
+				Spec: v1beta1.DeploymentSpec{
+					Strategy: v1beta1.DeploymentStrategy{
+						Type:          v1beta1.RollingUpdateDeploymentStrategyType,
+						RollingUpdate: &v1beta1.RollingUpdateDeployment{},
+					},
+				},
+			},
+			replicas: 3,
+			expected: 0,
+		},
+		{
+			comment: "percent value is rounded down against replicas",
+			deploy: v1beta1.Deployment{
+				Spec: v1beta1.DeploymentSpec{
+					Strategy: v1beta1.DeploymentStrategy{
+						Type: v1beta1.RollingUpdateDeploymentStrategyType,
+						RollingUpdate: &v1beta1.RollingUpdateDeployment{
+							MaxUnavailable: intOrStringPtr(intstr.FromString("25%")),
+						},
+					},
+				},
+			},
+			replicas: 10,
+			expected: 2,
+		},
+		{
+			comment: "absolute int value passes through unchanged",
+			deploy: v1beta1.Deployment{
+				Spec: v1beta1.DeploymentSpec{
+					Strategy: v1beta1.DeploymentStrategy{
+						Type: v1beta1.RollingUpdateDeploymentStrategyType,
+						RollingUpdate: &v1beta1.RollingUpdateDeployment{
+							MaxUnavailable: intOrStringPtr(intstr.FromInt(2)),
+						},
+					},
+				},
+			},
+			replicas: 10,
+			expected: 2,
+		},
+	}
+	for _, testCase := range testCases {
+		result, err := deploymentMaxUnavailable(&testCase.deploy, testCase.replicas)
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", testCase.comment, err)
+			continue
+		}
+		if result != testCase.expected {
+			t.Errorf("%v: expected %v, got %v", testCase.comment, testCase.expected, result)
+		}
+	}
+}
+
+func intOrStringPtr(v intstr.IntOrString) *intstr.IntOrString {
+	return &v
+}
@@ -15,13 +15,17 @@
 package rigging
 
 import (
+	"bufio"
+	"bytes"
 	"io"
 
 	"github.com/gravitational/trace"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/yaml"
 	"k8s.io/client-go/pkg/api"
 	"k8s.io/client-go/pkg/api/v1"
+	appsv1beta1 "k8s.io/client-go/pkg/apis/apps/v1beta1"
 	batchv1 "k8s.io/client-go/pkg/apis/batch/v1"
 	"k8s.io/client-go/pkg/apis/extensions/v1beta1"
 	"k8s.io/client-go/pkg/apis/rbac/v1alpha1"
@@ -42,6 +46,101 @@ func ParseResourceHeader(reader io.Reader) (*ResourceHeader, error) {
 	return &out, nil
 }
 
+// ParseAll reads a stream of YAML documents separated by "---", decoding
+// each into its concrete typed object based on its TypeMeta.Kind. It lets
+// callers apply a whole chart or kustomize-rendered manifest through
+// rigging without having to know the kinds it contains up front.
+func ParseAll(r io.Reader) ([]runtime.Object, error) {
+	reader := yaml.NewYAMLReader(bufio.NewReader(r))
+	var objects []runtime.Object
+	for {
+		doc, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+		header, err := ParseResourceHeader(bytes.NewReader(doc))
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		obj, err := parseByKind(header.Kind, bytes.NewReader(doc))
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		objects = append(objects, obj)
+	}
+	return objects, nil
+}
+
+// parseByKind decodes r into the typed object matching kind.
+func parseByKind(kind string, r io.Reader) (runtime.Object, error) {
+	switch kind {
+	case KindDeployment:
+		return ParseDeployment(r)
+	case KindDaemonSet:
+		return ParseDaemonSet(r)
+	case KindReplicationController:
+		return ParseReplicationController(r)
+	case KindJob:
+		return ParseJob(r)
+	case KindService:
+		return ParseService(r)
+	case KindConfigMap:
+		return ParseConfigMap(r)
+	case KindSecret:
+		return ParseSecret(r)
+	case KindServiceAccount:
+		return ParseServiceAccount(r)
+	case KindRole:
+		return ParseRole(r)
+	case KindClusterRole:
+		return ParseClusterRole(r)
+	case KindRoleBinding:
+		return ParseRoleBinding(r)
+	case KindClusterRoleBinding:
+		return ParseClusterRoleBinding(r)
+	case KindPodSecurityPolicy:
+		return ParsePodSecurityPolicy(r)
+	case KindStatefulSet:
+		return ParseStatefulSet(r)
+	case KindNamespace:
+		return ParseNamespace(r)
+	default:
+		return nil, trace.BadParameter("unsupported resource kind %q", kind)
+	}
+}
+
+// ParseNamespace parses a namespace from the specified reader
+func ParseNamespace(r io.Reader) (*v1.Namespace, error) {
+	if r == nil {
+		return nil, trace.BadParameter("missing reader")
+	}
+	namespace := v1.Namespace{}
+	err := yaml.NewYAMLOrJSONDecoder(r, DefaultBufferSize).Decode(&namespace)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &namespace, nil
+}
+
+// ParseStatefulSet parses a stateful set from the specified reader
+func ParseStatefulSet(r io.Reader) (*appsv1beta1.StatefulSet, error) {
+	if r == nil {
+		return nil, trace.BadParameter("missing reader")
+	}
+	statefulSet := appsv1beta1.StatefulSet{}
+	err := yaml.NewYAMLOrJSONDecoder(r, DefaultBufferSize).Decode(&statefulSet)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &statefulSet, nil
+}
+
 // ParseDaemonSet parses daemon set from reader
 func ParseDaemonSet(r io.Reader) (*v1beta1.DaemonSet, error) {
 	if r == nil {
@@ -71,6 +170,10 @@ func ParseJob(r io.Reader) (*batchv1.Job, error) {
 
 // ParseSerializedReference parses serialized reference object
 // used in annotations
+//
+// Deprecated: the kubernetes.io/created-by annotation this supports has
+// been removed from modern Kubernetes; controllers should walk
+// metadata.ownerReferences instead.
 func ParseSerializedReference(r io.Reader) (*api.SerializedReference, error) {
 	ref := api.SerializedReference{}
 	err := yaml.NewYAMLOrJSONDecoder(r, DefaultBufferSize).Decode(&ref)